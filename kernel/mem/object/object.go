@@ -0,0 +1,138 @@
+// Package object implements a small-object allocator backed by the
+// physical page allocator. Requests are rounded up to one of a small number
+// of fixed size classes and served out of spans: runs of pages carved into
+// equal-sized objects. This lets callers allocate arbitrary-sized kernel
+// heap objects without having to reason about page orders themselves, in
+// the spirit of tcmalloc and the mspan/mcentral/mcache design used by the
+// Go runtime's own allocator.
+package object
+
+import (
+	"github.com/achilleasa/gopher-os/kernel/errors"
+	"github.com/achilleasa/gopher-os/kernel/mem"
+	"github.com/achilleasa/gopher-os/kernel/mem/physical"
+)
+
+// sizeClasses lists the fixed object sizes (in bytes) served by Alloc. A
+// request is always rounded up to the smallest class that can hold it,
+// trading a bounded amount of internal fragmentation for a small, reusable
+// set of span layouts.
+var sizeClasses = [...]uint32{
+	8, 16, 24, 32, 48, 64, 80, 96, 112, 128,
+	160, 192, 224, 256, 320, 384, 448, 512,
+	640, 768, 896, 1024, 1280, 1536, 1792, 2048,
+	2560, 3072, 3584, 4096, 6144, 8192, 12288, 16384,
+}
+
+// minSpanObjects is the minimum number of objects a freshly allocated span
+// should be able to host. It drives the page order requested from the
+// physical allocator when a size class needs to be refilled.
+const minSpanObjects = 32
+
+var (
+	// ErrObjectTooLarge is returned by Alloc when size exceeds the
+	// largest available size class.
+	ErrObjectTooLarge = errors.KernelError("requested size exceeds the largest size class")
+
+	// ErrInvalidAddress is returned by Free when addr does not belong to
+	// a span owned by this allocator.
+	ErrInvalidAddress = errors.KernelError("address does not belong to a span managed by this allocator")
+
+	// classes holds the shared (cross-CPU) state for each size class in
+	// sizeClasses, indexed identically.
+	classes [len(sizeClasses)]sizeClassState
+)
+
+func init() {
+	for i, objSize := range sizeClasses {
+		classes[i].class = uint8(i)
+		classes[i].objSize = objSize
+		classes[i].order = spanOrderForSize(objSize)
+	}
+}
+
+// spanOrderForSize returns the smallest page order whose backing span can
+// host at least minSpanObjects objects of the given size.
+func spanOrderForSize(objSize uint32) mem.PageOrder {
+	for order := mem.PageOrder(0); order < mem.MaxPageOrder; order++ {
+		if (uint32(mem.PageSize)<<order)/objSize >= minSpanObjects {
+			return order
+		}
+	}
+
+	return mem.MaxPageOrder
+}
+
+// classFor returns the index into sizeClasses (and classes) of the smallest
+// size class able to hold size bytes.
+func classFor(size uint32) (int, error) {
+	for i, classSize := range sizeClasses {
+		if classSize >= size {
+			return i, nil
+		}
+	}
+
+	return 0, ErrObjectTooLarge
+}
+
+// Alloc returns the address of a free object able to hold size bytes. The
+// request is first served from the calling CPU's cached span for the
+// matching size class; if that span is full or not yet assigned, a
+// replacement is pulled from the size class' central list or, if that list
+// is empty, carved out of fresh pages from the physical page allocator.
+func Alloc(size uint32) (uintptr, error) {
+	classIdx, err := classFor(size)
+	if err != nil {
+		return 0, err
+	}
+
+	entry := &cpuCache[cpuIDFn()%maxCachedCPU][classIdx]
+
+	entry.lock.Lock()
+	if s := entry.span; s != nil && !s.full() {
+		addr := s.allocObject()
+		entry.lock.Unlock()
+		return addr, nil
+	}
+	entry.lock.Unlock()
+
+	s, err := classes[classIdx].acquireSpan()
+	if err != nil {
+		return 0, err
+	}
+
+	entry.lock.Lock()
+	entry.span = s
+	addr := s.allocObject()
+	entry.lock.Unlock()
+
+	return addr, nil
+}
+
+// Free releases the object previously returned by Alloc at addr. The span
+// owning addr is recovered via the page-indexed lookup table populated when
+// the span was created. If releasing addr leaves the span entirely free,
+// it is first unlinked from the central partial list and any per-CPU cache
+// entry still pointing at it, and its pages are returned to the physical
+// page allocator.
+func Free(addr uintptr) error {
+	s := spanForAddr(addr)
+	if s == nil {
+		return ErrInvalidAddress
+	}
+
+	wasFull := s.full()
+	s.freeObject(addr)
+
+	switch {
+	case s.empty():
+		classes[s.class].unlinkPartial(s)
+		clearCPUCache(s)
+		unregisterSpanPages(s)
+		return physical.PageAllocator.FreePage(s.base, s.order)
+	case wasFull:
+		classes[s.class].release(s)
+	}
+
+	return nil
+}
@@ -0,0 +1,249 @@
+package object
+
+import (
+	"math"
+	"math/bits"
+
+	kernelsync "github.com/achilleasa/gopher-os/kernel/sync"
+
+	"github.com/achilleasa/gopher-os/kernel/mem"
+	"github.com/achilleasa/gopher-os/kernel/mem/physical"
+)
+
+// maxCachedCPU bounds the number of per-CPU span caches tracked by this
+// allocator. It is a placeholder until the HAL exposes the actual number of
+// online CPUs.
+const maxCachedCPU = 32
+
+// cpuIDFn returns the index of the per-CPU span cache that should serve the
+// calling CPU. It always returns 0 until the HAL exposes a way to query the
+// executing CPU's id; tests override it to exercise multiple entries.
+var cpuIDFn = func() uint32 { return 0 }
+
+// spanCacheEntry holds the span that one CPU is currently allocating objects
+// from for one size class. The entry is guarded by its own lock rather than
+// relying on being touched by a single owning CPU: until the HAL can report
+// real CPU ids, cpuIDFn returns the same index for every caller, so distinct
+// CPUs do in fact contend for the same entry.
+type spanCacheEntry struct {
+	lock kernelsync.Spinlock
+	span *span
+}
+
+// cpuCache holds, for each CPU and size class, the spanCacheEntry that CPU
+// allocates objects from.
+var cpuCache [maxCachedCPU][len(sizeClasses)]spanCacheEntry
+
+// span describes a contiguous run of physical pages that has been carved
+// into objCount equal-sized objects belonging to a single size class.
+type span struct {
+	// next links this span into its size class' central partial list.
+	next *span
+
+	base    uintptr
+	order   mem.PageOrder
+	class   uint8
+	objSize uint32
+
+	objCount  uint32
+	freeCount uint32
+
+	// freeBitmap holds one bit per object; a set bit marks a free
+	// object. Spans are sized so objCount never exceeds 64*len(freeBitmap).
+	freeBitmap []uint64
+}
+
+// newSpan carves a freshly allocated, zero-based run of pages into objSize
+// objects and marks them all as free.
+func newSpan(base uintptr, order mem.PageOrder, class uint8, objSize uint32) *span {
+	spanBytes := uint32(mem.PageSize) << order
+	objCount := spanBytes / objSize
+
+	s := &span{
+		base:       base,
+		order:      order,
+		class:      class,
+		objSize:    objSize,
+		objCount:   objCount,
+		freeCount:  objCount,
+		freeBitmap: make([]uint64, (objCount+63)/64),
+	}
+
+	for i := range s.freeBitmap {
+		s.freeBitmap[i] = math.MaxUint64
+	}
+
+	// Clear the padding bits in the last word that do not correspond to
+	// a real object.
+	if rem := objCount % 64; rem != 0 {
+		s.freeBitmap[len(s.freeBitmap)-1] &^= math.MaxUint64 >> rem
+	}
+
+	return s
+}
+
+// full reports whether the span has no free objects left.
+func (s *span) full() bool { return s.freeCount == 0 }
+
+// empty reports whether every object in the span is free, meaning its pages
+// can be returned to the physical allocator.
+func (s *span) empty() bool { return s.freeCount == s.objCount }
+
+// allocObject reserves and returns the address of a free object inside the
+// span. Callers must ensure the span is not already full.
+func (s *span) allocObject() uintptr {
+	for i, word := range s.freeBitmap {
+		if word == 0 {
+			continue
+		}
+
+		bit := bits.LeadingZeros64(word)
+		s.freeBitmap[i] &^= 1 << uint(63-bit)
+		s.freeCount--
+
+		return s.base + uintptr(i*64+bit)*uintptr(s.objSize)
+	}
+
+	return 0
+}
+
+// freeObject releases the object at addr back to the span.
+func (s *span) freeObject(addr uintptr) {
+	objIndex := uint32((addr - s.base) / uintptr(s.objSize))
+	word, bit := objIndex/64, objIndex%64
+
+	s.freeBitmap[word] |= 1 << (63 - bit)
+	s.freeCount++
+}
+
+// sizeClassState tracks the shared, cross-CPU state for a single size
+// class: the fixed object size/page order it is served from and a central
+// list of spans that still have at least one free object.
+type sizeClassState struct {
+	lock kernelsync.Spinlock
+
+	class   uint8
+	objSize uint32
+	order   mem.PageOrder
+
+	// partial holds spans with at least one free object, linked through
+	// span.next.
+	partial *span
+}
+
+// acquireSpan returns a span with at least one free object, pulling one off
+// the central partial list or refilling it from the physical page
+// allocator if the list is empty.
+func (c *sizeClassState) acquireSpan() (*span, error) {
+	c.lock.Lock()
+	if s := c.partial; s != nil {
+		c.partial = s.next
+		s.next = nil
+		c.lock.Unlock()
+		return s, nil
+	}
+	c.lock.Unlock()
+
+	addr, err := physical.PageAllocator.AllocatePage(c.order, physical.FlagKernel)
+	if err != nil {
+		return nil, err
+	}
+
+	s := newSpan(addr, c.order, c.class, c.objSize)
+	registerSpanPages(s)
+
+	return s, nil
+}
+
+// release returns a span that has gained a free object back to the central
+// partial list so other CPUs can allocate from it. s is first cleared from
+// every per-CPU cache entry still pointing at it: otherwise the CPU that
+// had it cached could keep calling allocObject on it, under its own
+// entry.lock, at the same time as whoever next pops s off partial allocates
+// from it under a different lock.
+func (c *sizeClassState) release(s *span) {
+	clearCPUCache(s)
+
+	c.lock.Lock()
+	s.next = c.partial
+	c.partial = s
+	c.lock.Unlock()
+}
+
+// unlinkPartial removes s from the central partial list if it is currently
+// linked there. It is called before a span's pages are handed back to the
+// physical allocator, so acquireSpan can never afterwards hand out a span
+// whose pages have already been freed.
+func (c *sizeClassState) unlinkPartial(s *span) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.partial == s {
+		c.partial = s.next
+		s.next = nil
+		return
+	}
+
+	for cur := c.partial; cur != nil && cur.next != nil; cur = cur.next {
+		if cur.next == s {
+			cur.next = s.next
+			s.next = nil
+			return
+		}
+	}
+}
+
+// clearCPUCache removes s from every per-CPU cache entry for its size class,
+// so a stale pointer can never be handed back out once its pages are freed.
+func clearCPUCache(s *span) {
+	for cpu := range cpuCache {
+		entry := &cpuCache[cpu][s.class]
+		entry.lock.Lock()
+		if entry.span == s {
+			entry.span = nil
+		}
+		entry.lock.Unlock()
+	}
+}
+
+var (
+	pageSpanLock kernelsync.Spinlock
+	pageSpan     = map[uintptr]*span{}
+)
+
+// registerSpanPages records, for every page backing s, that it belongs to s
+// so that Free can later recover the span from an object address alone.
+func registerSpanPages(s *span) {
+	pageCount := uintptr(1) << uint(s.order)
+
+	pageSpanLock.Lock()
+	defer pageSpanLock.Unlock()
+
+	for i := uintptr(0); i < pageCount; i++ {
+		pageSpan[s.base+i*uintptr(mem.PageSize)] = s
+	}
+}
+
+// unregisterSpanPages removes the lookup entries added by registerSpanPages
+// once a span's pages have been returned to the physical page allocator.
+func unregisterSpanPages(s *span) {
+	pageCount := uintptr(1) << uint(s.order)
+
+	pageSpanLock.Lock()
+	defer pageSpanLock.Unlock()
+
+	for i := uintptr(0); i < pageCount; i++ {
+		delete(pageSpan, s.base+i*uintptr(mem.PageSize))
+	}
+}
+
+// spanForAddr returns the span that owns the page containing addr, or nil
+// if addr does not fall within any span tracked by this allocator.
+func spanForAddr(addr uintptr) *span {
+	pageBase := addr &^ (uintptr(mem.PageSize) - 1)
+
+	pageSpanLock.Lock()
+	defer pageSpanLock.Unlock()
+
+	return pageSpan[pageBase]
+}
@@ -1,9 +1,7 @@
 package physical
 
 import (
-	"math"
-	"reflect"
-	"unsafe"
+	"sync/atomic"
 
 	"github.com/achilleasa/gopher-os/kernel/errors"
 	"github.com/achilleasa/gopher-os/kernel/hal/multiboot"
@@ -23,6 +21,14 @@ const (
 
 	// FlagDoNotClear instructs the allocator not to clear the page contents.
 	FlagDoNotClear
+
+	// FlagDMA requests a page from ZoneDMA. Unlike regular requests, DMA
+	// requests are never satisfied by falling back to ZoneNormal.
+	FlagDMA
+
+	// FlagEmergency allows a request to dip into ZoneReserve once
+	// ZoneNormal and ZoneDMA have both been exhausted.
+	FlagEmergency
 )
 
 type reservationMode uint8
@@ -45,389 +51,251 @@ var (
 )
 
 type buddyAllocator struct {
-	// freeCount stores the number of free pages for each allocation order.
-	// Initially, only the last order contains free pages. Having a free
-	// counter allows us to quickly detect when the lower orders have no
-	// pages available so we can immediately start scanning the higher orders.
-	freeCount [mem.MaxPageOrder + 1]uint32
-
-	// freeBitmap stores the free page bitmap data for each allocation order.
-	// The bitmap for each order is stored as a []uint64. This allows us
-	// to quickly traverse the bitmap when we search for a page to allocate
-	// by examining 64 pages at a time (using bitwise ANDs) and only scan
-	// individual bits when we are sure that one of the blocks contains a
-	// free page.
-	freeBitmap [mem.MaxPageOrder + 1][]uint64
-
-	// bitmapSlice stores the slice structures for the freeBitmap entries.
-	// It allows us to perform 2 passes to allocate their content. The first
-	// pass populates their Len and Cap values with the number of required bits.
-	// After calculating the total required bits for all bitmaps we perform a
-	// second pass where we scan the available memory blocks looking for a
-	// block that can fit all bitmaps and adjust the slice Data pointers
-	// accordingly.
-	bitmapSlice [mem.MaxPageOrder + 1]reflect.SliceHeader
+	// zones partitions the available physical memory into independently
+	// tracked regions (see Zone). Each zone owns its own set of buddy
+	// bitmaps and locks, built and scanned during Init, so allocations
+	// and frees against different zones never contend for each other's
+	// bitmap locks.
+	zones [zoneCount]zone
+
+	// cpuCache holds a per-CPU fast-path cache of individual pages so
+	// that order-0 allocations and frees can usually avoid the target
+	// zone's locks altogether. The cache is refilled from ZoneNormal, or
+	// from ZoneDMA once ZoneNormal is exhausted.
+	cpuCache [maxCachedCPU]pageCacheEntry
+
+	// allocations, frees and failedAllocations count calls to
+	// AllocatePage/AllocatePageForOwner and FreePage across every zone.
+	// They are updated with atomic.AddUint64 and surfaced via Stats.
+	allocations       uint64
+	frees             uint64
+	failedAllocations uint64
 }
 
-// Init bootstraps the physical page allocator. The initialization sequence
-// consists of 3 phases:
+// Init bootstraps the physical page allocator. Available memory is first
+// partitioned into ZoneDMA, ZoneNormal and ZoneReserve (see Zone); each zone
+// is then bootstrapped independently by zone.init:
 //
-// The available memory is converted into pages and then the allocator estimates
-// the required space for storing the free page bitmaps for those pages. The
-// allocator then scans through the available memory blocks looking for the first
-// available free region that is large enough to store the bitmap data.
+// Every MaxPageOrder-sized block of the zone's available memory is marked
+// free in the zone's bitmaps. The bitmaps are sparse (see bitmap.go): their
+// chunks are carved out of available memory the first time the address
+// range they cover is touched, so no single region large enough to hold
+// every bitmap has to be found upfront.
 //
-// Once a large-enough memory block has been found, the allocator will setup the
-// bitmap slices so that their contents are mapped to the selected memory block.
+// Once every block has been marked free, the pages carved for bitmap chunks
+// while the zone was being initialized, within the zone's own range, are
+// marked reserved again.
 //
-// Finally, the allocator will perform another pass where all memory regions are
-// examined and the appropriate bitmaps are marked as free or reserved.
-//
-// If the allocator cannot find a free memory block for storing its bitmaps, an
+// zone.init never fails (running out of early memory for a bitmap chunk
+// panics instead), so no
 // error will be returned.
 func (alloc *buddyAllocator) Init(totalMemory mem.Size) error {
-	var alignment = 8 * mem.Byte
-
-	alloc.setBitmapSizes(totalMemory.Pages())
-
-	// Each slice entry is a uint64 and takes 8 bytes of space
-	var requiredSpace uint64
-	for _, slice := range alloc.bitmapSlice {
-		requiredSpace += uint64(slice.Len << 3)
-	}
-
-	// Find a block large enough to hold the bitmap data
-	var foundRegion bool
-	var alignedBitmapAddr uint64
+	var minAddr, maxAddr uint64
 	visitMemRegionFn(func(entry *multiboot.MemoryMapEntry) {
-		if foundRegion || entry.Type != multiboot.MemAvailable {
+		if entry.Type != multiboot.MemAvailable {
 			return
 		}
 
-		// Our bitmap data needs to be aligned to a qword boundary; when
-		// we align the physAddr, the actual available region length may
-		// decrease so we need to take that into account
-		alignedAddr := mem.Align(entry.PhysAddress, alignment)
-		if entry.Length-(alignedAddr-entry.PhysAddress) < requiredSpace {
-			return
+		if minAddr == 0 || entry.PhysAddress < minAddr {
+			minAddr = entry.PhysAddress
+		}
+		if end := entry.PhysAddress + entry.Length; end > maxAddr {
+			maxAddr = end
 		}
-
-		foundRegion = true
-		alignedBitmapAddr = alignedAddr
 	})
 
-	if !foundRegion {
-		return mem.ErrOutOfMemory
+	reserveBytes := uint64(reserveZonePages) * uint64(mem.PageSize)
+	reserveStart := maxAddr - reserveBytes
+	dmaEnd := dmaZoneLimit
+	if dmaEnd > reserveStart {
+		dmaEnd = reserveStart
 	}
 
-	// Overlay the bitmaps to the selected region
-	alloc.setBitmapPointers(uintptr(alignedBitmapAddr))
-
-	// Mark all bitmaps as reseved
-	mem.Memset(uintptr(alignedBitmapAddr), 0xFF, uint32(requiredSpace))
-
-	// Scan all free memory regions marking their MaxPageOrder block as available
-	maxOrderPageSize := uint64(mem.PageSize << mem.MaxPageOrder)
-	visitMemRegionFn(func(entry *multiboot.MemoryMapEntry) {
-		if entry.Type != multiboot.MemAvailable {
-			return
-		}
+	bounds := [zoneCount][2]uint64{
+		ZoneDMA:     {minAddr, dmaEnd},
+		ZoneNormal:  {dmaEnd, reserveStart},
+		ZoneReserve: {reserveStart, maxAddr},
+	}
 
-		// Align physical address and decrease its available length if this
-		// is where we store our bitmap data.
-		alignedAddr := mem.Align(entry.PhysAddress, alignment)
-		if alignedAddr == alignedBitmapAddr {
-			alignedAddr = mem.Align(alignedAddr+requiredSpace, alignment)
+	for zoneIndex := range alloc.zones {
+		start, end := bounds[zoneIndex][0], bounds[zoneIndex][1]
+		if end <= start {
+			continue
 		}
-		regionLen := entry.Length - (alignedAddr - entry.PhysAddress)
 
-		pageBlocks := regionLen / maxOrderPageSize
-		for index := uint64(0); index < pageBlocks; index++ {
-			blockAddr := alignedAddr + (index * maxOrderPageSize)
-			bitIndex := bitmapIndex(uintptr(blockAddr), mem.MaxPageOrder)
-			block := bitIndex >> 6
-			blockOffset := bitIndex & 63
-
-			alloc.freeBitmap[mem.MaxPageOrder][block] &^= (1 << (63 - blockOffset))
-			alloc.freeCount[mem.MaxPageOrder]++
+		if err := alloc.zones[zoneIndex].init(start, end); err != nil {
+			return err
 		}
-	})
+	}
 
 	return nil
 }
 
 // AllocatePage allocates a page with the given size (order) and returns back
 // its address or an error if no free pages are available.
+//
+// Requests for order <= pageCacheMaxOrder that do not pass FlagDMA are first
+// served from the calling CPU's page cache entry; the target zone's locks are
+// only touched when that cache needs to be refilled, when a higher order is
+// requested or when FlagDMA is set.
 func (alloc *buddyAllocator) AllocatePage(order mem.PageOrder, flags Flag) (uintptr, error) {
-	// Sanity checks
-	if order > mem.MaxPageOrder {
-		return uintptr(0), errors.ErrInvalidParamValue
-	}
-
-	// If no pages are free at the requested order we may need to split a
-	// higher order page to make some room.
-	if alloc.freeCount[order] == 0 {
-		err := alloc.splitHigherOrderPage(order)
-		if err != nil {
-			return uintptr(0), err
+	if order <= pageCacheMaxOrder && flags&FlagDMA == 0 {
+		if addr, ok := alloc.cachedPage(order); ok {
+			setPageTag(addr, TagAnonymous)
+			atomic.AddUint64(&alloc.allocations, 1)
+			return finishAllocatePage(addr, order, flags)
 		}
-	}
-
-	// Since we are guaranteed to find a free page this call can never fail
-	addr, _ := alloc.reserveFreePage(order)
 
-	alloc.updateLowerOrderBitmaps(addr, order, markReserved)
-	alloc.updateHigherOrderBitmaps(addr, order)
-
-	if (flags & (FlagClear | FlagDoNotClear)) == FlagClear {
-		memsetFn(addr, 0, uint32(mem.PageSize)<<order)
+		if err := alloc.refillCache(); err == nil {
+			if addr, ok := alloc.cachedPage(order); ok {
+				setPageTag(addr, TagAnonymous)
+				atomic.AddUint64(&alloc.allocations, 1)
+				return finishAllocatePage(addr, order, flags)
+			}
+		}
 	}
 
-	return addr, nil
+	return alloc.allocatePageLockedForOwner(order, flags, TagAnonymous)
 }
 
-// FreePage releases a previously allocated page with the given size/order.
-func (alloc *buddyAllocator) FreePage(addr uintptr, order mem.PageOrder) error {
-	// Sanity checks
-	if order > mem.MaxPageOrder {
-		return errors.ErrInvalidParamValue
-	}
-
-	bitIndex := bitmapIndex(addr, order)
-	block := bitIndex >> 6
-	mask := uint64(1 << (63 - (bitIndex & 63)))
-	if alloc.freeBitmap[order][block]&mask != mask {
-		return ErrPageNotAllocated
-	}
-
-	// Clear the allocated bit and increase free count for this order
-	alloc.freeBitmap[order][block] &^= mask
-	alloc.freeCount[order]++
-
-	// Propagate the changes to the other orders
-	alloc.updateLowerOrderBitmaps(addr, order, markFree)
-	alloc.updateHigherOrderBitmaps(addr, order)
-
-	return nil
+// AllocatePageForOwner behaves like AllocatePage but records tag as the
+// allocated page's owner instead of the default TagAnonymous. Compact
+// consults this tag, via the PageMover registered for it, to decide whether
+// the page may be relocated during a compaction pass.
+func (alloc *buddyAllocator) AllocatePageForOwner(order mem.PageOrder, flags Flag, tag Tag) (uintptr, error) {
+	return alloc.allocatePageLockedForOwner(order, flags, tag)
 }
 
-// splitHigherOrderPage searches for the first available page with order greater
-// than the requested order. If a free page is found, it is marked as reserved and
-// the free counts for the orders below it are updated accordingly.
-func (alloc *buddyAllocator) splitHigherOrderPage(order mem.PageOrder) error {
-	for order = order + 1; order <= mem.MaxPageOrder; order++ {
-		if alloc.freeCount[order] == 0 {
-			continue
-		}
-
-		// This order has free pages. Reserve the first available and
-		// make its space available to the order below it
-		alloc.reserveFreePage(order)
-		alloc.incFreeCountForLowerOrders(order)
-		return nil
+// allocatePageLockedForOwner implements the slow-path buddy allocation
+// shared by AllocatePage and AllocatePageForOwner, updating the public
+// allocations/failedAllocations counters around reservePage.
+func (alloc *buddyAllocator) allocatePageLockedForOwner(order mem.PageOrder, flags Flag, tag Tag) (uintptr, error) {
+	addr, err := alloc.reservePage(order, flags, tag)
+	if err != nil {
+		atomic.AddUint64(&alloc.failedAllocations, 1)
+		return uintptr(0), err
 	}
 
-	return mem.ErrOutOfMemory
+	atomic.AddUint64(&alloc.allocations, 1)
+	return finishAllocatePage(addr, order, flags)
 }
 
-// reserveFreePage scans the free page bitmaps for the given order, reserves the
-// first available page and returns its address. If no pages at this order are
-// available then this method returns ErrOutOfMemory.
-func (alloc *buddyAllocator) reserveFreePage(order mem.PageOrder) (uintptr, error) {
+// reservePage tries each zone in zoneFallbackOrder(flags), in turn, stopping
+// at the first one able to satisfy order; each zone synchronizes its own
+// allocation internally, so no allocator-wide lock is held here.
+//
+// Unlike allocatePageLockedForOwner, reservePage does not update the public
+// allocations/failedAllocations counters. refillCache uses it to reserve an
+// entire pageCacheOrder run for the per-CPU page cache: that run is later
+// handed out (and separately counted) one cached page at a time, so
+// counting the run itself here would inflate Allocations past Frees, since
+// the run is never released as a single unit via FreePage.
+func (alloc *buddyAllocator) reservePage(order mem.PageOrder, flags Flag, tag Tag) (uintptr, error) {
 	if order > mem.MaxPageOrder {
 		return uintptr(0), errors.ErrInvalidParamValue
 	}
 
-	for blockIndex, block := range alloc.freeBitmap[order] {
-		// Entire block is allocated; skip it
-		if block == math.MaxUint64 {
-			continue
-		}
-
-		// Scan the individual bits to find the block and reserve it
-		for bitIndex := uint8(0); bitIndex < 64; bitIndex++ {
-			mask := uint64(1 << (63 - bitIndex))
-
-			// Ignore used bits
-			if (block & mask) != 0 {
-				continue
-			}
-
-			// Mark page as allocated and decrement the free page count for this order
-			alloc.freeBitmap[order][blockIndex] |= mask
-			alloc.freeCount[order]--
-
-			return uintptr(mem.PageSize) * ((uintptr(blockIndex) << 6) + uintptr(bitIndex)), nil
+	var lastErr error = mem.ErrOutOfMemory
+	for _, z := range alloc.zoneFallbackOrder(flags) {
+		addr, err := z.allocatePage(order)
+		if err == nil {
+			setPageTag(addr, tag)
+			return addr, nil
 		}
+		lastErr = err
 	}
 
-	return uintptr(0), mem.ErrOutOfMemory
+	return uintptr(0), lastErr
 }
 
-// updateLowerOrderBitmaps hierarchically traverses the free bitmaps at the orders
-// below the supplied order and depending on the requested reservation mode either
-// sets or unsets the used bits that correspond to the supplied address.
-func (alloc *buddyAllocator) updateLowerOrderBitmaps(addr uintptr, order mem.PageOrder, mode reservationMode) {
-	order--
-
-	var (
-		firstBitIndex                     = bitmapIndex(addr, order)
-		totalBitCount              uint32 = 2
-		bitsToChange, lastBitIndex uint32
-	)
-
-	for ; order >= 0 && order <= mem.MaxPageOrder; order = order - 1 {
-		lastBitIndex = firstBitIndex + totalBitCount
-		for bitIndex := firstBitIndex; bitIndex < lastBitIndex; bitIndex += bitsToChange {
-			block := bitIndex >> 6
-			blockOffset := bitIndex & 63
-
-			// We need to change min(64, lastBitIndex - bitIndex) bits in this block
-			bitsToChange = lastBitIndex - bitIndex
-			if bitsToChange > 64 {
-				bitsToChange = 64
-			}
-
-			// To build the block mask we start with a value with the
-			// bitsToChange LSB set and shift it right so it alignts with
-			// the offset position in the block
-			blockMask := uint64(((1 << (bitsToChange)) - 1) << (64 - blockOffset - bitsToChange))
-
-			// Mark either as reserved (set to 1) or free (set to 0)
-			if mode == markReserved {
-				alloc.freeBitmap[order][block] |= blockMask
-			} else {
-				alloc.freeBitmap[order][block] &^= blockMask
-			}
-		}
-
-		switch {
-		// Initially only the MaxPageOrder free count is > 0; all lower-order free counts are 0.
-		// If we directly allocate a MaxPageOrder page, this can cause an underflow
-		case mode == markReserved && alloc.freeCount[order] >= totalBitCount:
-			alloc.freeCount[order] -= totalBitCount
-		case mode == markFree:
-			alloc.freeCount[order] += totalBitCount
-		}
-
-		// Each time we descend an order the first bit index and the number
-		// of bits we need to set/unset doubles
-		firstBitIndex <<= 1
-		totalBitCount <<= 1
+// zoneFallbackOrder returns, in the order they should be tried, the zones
+// eligible to satisfy a request made with the given flags.
+//
+// FlagDMA requests are only ever satisfied from ZoneDMA: DMA requests must
+// not be satisfied from ZoneNormal. Regular requests prefer ZoneNormal and
+// fall back to ZoneDMA once it is exhausted. ZoneReserve is only considered
+// when FlagEmergency is set, guaranteeing that a handful of pages remain
+// available even when both other zones are full.
+func (alloc *buddyAllocator) zoneFallbackOrder(flags Flag) []*zone {
+	if flags&FlagDMA != 0 {
+		return []*zone{&alloc.zones[ZoneDMA]}
 	}
-}
 
-// updateHigherOrderBitmaps hierarchically traverses the free bitmaps from lower
-// to higher orders and for each order, updates the page bit that corresponds
-// to the supplied physical address based on the value of the 2 buddy pages of
-// the order below it. The status of page at ord(N) is set to the OR-ed value
-// of the 2 buddy pages at ord(N-1).
-func (alloc *buddyAllocator) updateHigherOrderBitmaps(addr uintptr, order mem.PageOrder) {
-	// sanity checks
-	if order > mem.MaxPageOrder {
-		return
+	zones := []*zone{&alloc.zones[ZoneNormal], &alloc.zones[ZoneDMA]}
+	if flags&FlagEmergency != 0 {
+		zones = append(zones, &alloc.zones[ZoneReserve])
 	}
+	return zones
+}
 
-	// ord(0) has no children
-	if order == 0 {
-		order++
+// finishAllocatePage applies the FlagClear/FlagDoNotClear contract shared by
+// both the cached and uncached AllocatePage paths.
+func finishAllocatePage(addr uintptr, order mem.PageOrder, flags Flag) (uintptr, error) {
+	if (flags & (FlagClear | FlagDoNotClear)) == FlagClear {
+		memsetFn(addr, 0, uint32(mem.PageSize)<<order)
 	}
 
-	var bitIndex, block, childBitIndex, childBlock uint32
-	var blockMask, childBlockMask uint64
-	var wasReserved bool
-	for bitIndex = bitmapIndex(addr, order); order <= mem.MaxPageOrder; order, bitIndex = order+1, bitIndex>>1 {
-		block = bitIndex >> 6
-		blockMask = 1 << (63 - (bitIndex & 63))
-		wasReserved = (alloc.freeBitmap[order][block] & blockMask) == blockMask
-
-		// This bit should be marked as used any of the (ord-1) bits:
-		// (2*bit)+1 or (2*bit)+2 are marked as used. The child mask
-		// that includes these bits is calculated by shifting the
-		// value "3" (11b) left childBitIndex positions.
-		childBitIndex = (bitIndex << 1) + 1
-		childBlock = childBitIndex >> 6
-		childBlockMask = 3 << (63 - (childBitIndex & 63))
-
-		switch alloc.freeBitmap[order-1][childBlock] & childBlockMask {
-		case 0: // both bits are not set; we just need to clear the bit
-			alloc.freeBitmap[order][block] &^= blockMask
-
-			if wasReserved {
-				alloc.freeCount[order]++
-			}
-		default: // one or both bits are set; we just need to set the bit
-			alloc.freeBitmap[order][block] |= blockMask
+	return addr, nil
+}
 
-			if !wasReserved {
-				alloc.freeCount[order]--
-			}
-		}
+// FreePage releases a previously allocated page with the given size/order.
+//
+// If addr falls within a CPU-owned page cache chunk, the page is recycled
+// directly into that cache entry without touching the owning zone's locks.
+func (alloc *buddyAllocator) FreePage(addr uintptr, order mem.PageOrder) error {
+	if alloc.freeCachedPage(addr, order) {
+		atomic.AddUint64(&alloc.frees, 1)
+		return nil
 	}
+
+	return alloc.freePageLocked(addr, order)
 }
 
-// incFreeCountForLowerOrders is called when a free page at ord(N) is allocated
-// to update all free page counters for all orders less than or equal to N. The
-// number of free pages that are added to the counters doubles for each order less than N.
-func (alloc *buddyAllocator) incFreeCountForLowerOrders(order mem.PageOrder) {
-	// sanity check
-	if order > mem.MaxPageOrder {
-		return
+// freePageLocked implements the slow-path buddy free described by FreePage,
+// updating the public frees counter around releasePage.
+func (alloc *buddyAllocator) freePageLocked(addr uintptr, order mem.PageOrder) error {
+	if err := alloc.releasePage(addr, order); err != nil {
+		return err
 	}
 
-	// When ord reaches 0; ord - 1 will wrap to MaxUint32 so we need to check for that as well
-	freeCount := uint32(2)
-	for order = order - 1; order >= 0 && order <= mem.MaxPageOrder; order, freeCount = order-1, freeCount<<1 {
-		alloc.freeCount[order] += freeCount
-	}
+	atomic.AddUint64(&alloc.frees, 1)
+	return nil
 }
 
-// setBitmapSizes updates the Len and Cap fields of the allocator's bitmap slice
-// headers to the required number of bits for each allocation order.
-//
-// Given N pages of size mem.Pagemem.PageOrder:
-// the bitmap for order(0) uses align(N, 64) bits, one for each block with size (mem.Pagemem.PageOrder << 0)
-// the bitmap for order(M) uses ceil(N / M) bits, one for each block with size (mem.Pagemem.PageOrder << M)
+// releasePage returns a previously reserved page to its owning zone, which
+// is recovered from addr itself so callers never need to track which zone a
+// page came from.
 //
-// Since we use []uint64 for our bitmap entries, this method will pad the required
-// number of bits per order so they are multiples of 64.
-func (alloc *buddyAllocator) setBitmapSizes(pageCount uint32) {
-	for order := mem.PageOrder(0); order <= mem.MaxPageOrder; order++ {
-		requiredUint64 := requiredUint64(pageCount, order)
-		alloc.bitmapSlice[order].Cap, alloc.bitmapSlice[order].Len = requiredUint64, requiredUint64
+// Unlike freePageLocked, releasePage does not update the public frees
+// counter. refillCache uses it to give back a pageCacheOrder run that lost
+// the race to populate a page cache entry: since that run was reserved via
+// reservePage (which likewise left allocations untouched), giving it back
+// here must not touch frees either, or the two counters would drift apart.
+func (alloc *buddyAllocator) releasePage(addr uintptr, order mem.PageOrder) error {
+	if order > mem.MaxPageOrder {
+		return errors.ErrInvalidParamValue
 	}
-}
 
-// setBitmapPointers updates the Data field for the allocator's bitmap slice
-// headers so that each slice's data begins at a 8-byte aligned offset after the
-// provided baseAddr value.
-//
-// This method also patches the freeBitmap slice entries so that they point to the
-// populated slice header structs.
-//
-// After a call to setBitmapPointers, the allocator will be able to freely access
-// all freeBitmap entries.
-func (alloc *buddyAllocator) setBitmapPointers(baseAddr uintptr) {
-	var dataPtr = baseAddr
-	for ord := mem.PageOrder(0); ord <= mem.MaxPageOrder; ord++ {
-		alloc.bitmapSlice[ord].Data = dataPtr
-		alloc.freeBitmap[ord] = *(*[]uint64)(unsafe.Pointer(&alloc.bitmapSlice[ord]))
-
-		// offset += ordLen * 8 bytes per uint64
-		dataPtr += uintptr(alloc.bitmapSlice[ord].Len << 3)
+	z := alloc.zoneForAddr(addr)
+	if z == nil {
+		return ErrPageNotAllocated
 	}
-}
 
-// bitmapIndex returns the index of bit in the bitmap for the given order that
-// corresponds to the page located at the given address.
-func bitmapIndex(addr uintptr, order mem.PageOrder) uint32 {
-	return uint32(addr >> (mem.PageShift + order))
+	if err := z.freePage(addr, order); err != nil {
+		return err
+	}
+
+	clearPageTag(addr)
+	return nil
 }
 
-// requiredUint64 returns the number of uint64 required for storing a bitmap
-// of order(ord) for pageCount pages.
-func requiredUint64(pageCount uint32, order mem.PageOrder) int {
-	// requiredBits = pageCount / (2*ord) + pageCount % (2*ord)
-	requiredBits := uint64((pageCount >> order) + (pageCount & ((1 << order) - 1)))
-	return int(mem.Align(requiredBits, 64*mem.Byte) >> 6)
+// zoneForAddr returns the zone that owns addr, or nil if addr does not fall
+// within any known zone.
+func (alloc *buddyAllocator) zoneForAddr(addr uintptr) *zone {
+	for i := range alloc.zones {
+		if alloc.zones[i].contains(addr) {
+			return &alloc.zones[i]
+		}
+	}
+	return nil
 }
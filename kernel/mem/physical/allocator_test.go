@@ -0,0 +1,90 @@
+package physical
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"unsafe"
+
+	"github.com/achilleasa/gopher-os/kernel/hal/multiboot"
+	"github.com/achilleasa/gopher-os/kernel/mem"
+)
+
+// testMemSize is large enough to give the allocator several MaxPageOrder
+// blocks once ZoneDMA/ZoneReserve are carved out of it, so the stress test
+// below also exercises splitHigherOrderPage and the buddy-merge path in
+// updateHigherOrderBitmaps, not just the order-0 fast path.
+const testMemSize = 64 << 20
+
+// TestBuddyAllocatorConcurrentAllocateFree hammers a single buddyAllocator
+// with concurrent order-0 allocations and frees from multiple goroutines. It
+// fails if any two goroutines ever observe the same page as allocated at the
+// same time, and checks that the allocator's own bookkeeping agrees with
+// what actually happened once every goroutine is done.
+func TestBuddyAllocatorConcurrentAllocateFree(t *testing.T) {
+	backing := make([]byte, testMemSize)
+	base := uint64(uintptr(unsafe.Pointer(&backing[0])))
+
+	savedVisit := visitMemRegionFn
+	defer func() { visitMemRegionFn = savedVisit }()
+	visitMemRegionFn = func(visitor func(*multiboot.MemoryMapEntry)) {
+		visitor(&multiboot.MemoryMapEntry{
+			PhysAddress: base,
+			Length:      testMemSize,
+			Type:        multiboot.MemAvailable,
+		})
+	}
+
+	var alloc buddyAllocator
+	if err := alloc.Init(mem.Size(testMemSize)); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	const (
+		goroutineCount = 8
+		iterCount      = 200
+	)
+
+	var (
+		wg     sync.WaitGroup
+		live   sync.Map // addr (uintptr) -> struct{}; catches double-allocation
+		failed int32
+	)
+
+	for g := 0; g < goroutineCount; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			held := make([]uintptr, 0, iterCount)
+			for i := 0; i < iterCount; i++ {
+				addr, err := alloc.AllocatePage(0, FlagDoNotClear)
+				if err != nil {
+					atomic.AddInt32(&failed, 1)
+					continue
+				}
+
+				if _, dup := live.LoadOrStore(addr, struct{}{}); dup {
+					t.Errorf("page %#x allocated twice concurrently", addr)
+				}
+
+				held = append(held, addr)
+			}
+
+			for _, addr := range held {
+				live.Delete(addr)
+				if err := alloc.FreePage(addr, 0); err != nil {
+					t.Errorf("FreePage(%#x): %v", addr, err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	stats := alloc.Stats()
+	if stats.Allocations != stats.Frees {
+		t.Fatalf("expected Allocations == Frees, got %d allocations and %d frees", stats.Allocations, stats.Frees)
+	}
+	t.Logf("allocations=%d frees=%d splits=%d merges=%d failed=%d", stats.Allocations, stats.Frees, stats.Splits, stats.Merges, failed)
+}
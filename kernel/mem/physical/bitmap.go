@@ -0,0 +1,236 @@
+package physical
+
+import (
+	"math"
+	"unsafe"
+
+	"github.com/achilleasa/gopher-os/kernel/hal/multiboot"
+	"github.com/achilleasa/gopher-os/kernel/mem"
+	kernelsync "github.com/achilleasa/gopher-os/kernel/sync"
+)
+
+const (
+	// bitmapChunkWords is the number of uint64 words held by a single L2
+	// bitmap chunk.
+	bitmapChunkWords = 64
+
+	// bitmapChunkBits is the number of pages (bits) covered by a single
+	// L2 bitmap chunk.
+	bitmapChunkBits = bitmapChunkWords * 64
+)
+
+// bitmapChunk is a single, lazily-allocated L2 chunk of a zone's free page
+// bitmap for one order, covering bitmapChunkBits consecutive pages.
+type bitmapChunk struct {
+	words [bitmapChunkWords]uint64
+
+	// allOnes carries one bit per entry in words; bit i is set when
+	// words[i] == math.MaxUint64 (i.e. every page it tracks is
+	// reserved). Because a chunk holds exactly 64 words, the whole
+	// summary fits in a single word, letting reserveFreePage skip an
+	// entirely-allocated chunk with one comparison instead of scanning
+	// all of its words.
+	allOnes uint64
+}
+
+// bitmap is a sparse, two-level free-page bitmap for a single allocation
+// order. l1 holds one *bitmapChunk slot per bitmapChunkBits-sized run of
+// the order's bit range; a slot stays nil until a page inside its range is
+// actually touched, and a nil slot is treated as fully reserved. This means
+// address ranges that never back real RAM (PCI holes, MMIO above 4GiB)
+// never need any bitmap storage at all.
+type bitmap struct {
+	l1 []*bitmapChunk
+}
+
+// chunkAllocator hands out zero-based, fully-reserved bitmapChunk-sized
+// blocks of memory carved directly out of available multiboot regions. It
+// backs bitmap chunks lazily so that a zone's Init no longer needs to find
+// one giant region large enough to hold every order's bitmap upfront.
+type chunkAllocator struct {
+	cursor    uint64
+	remaining uint64
+}
+
+// earlyAllocWatermark is the highest physical address handed out so far by
+// any chunkAllocator. It is shared across all zones so that a refill never
+// re-hands out memory that an earlier refill (for this or another zone's
+// bitmaps) already consumed. It is only ever read or written while holding
+// chunkAllocLock.
+var earlyAllocWatermark uint64
+
+// chunkAllocLock serializes allocChunk across every zone, together with the
+// shared earlyAllocWatermark it advances. A single zone can have ensureChunk
+// called concurrently for two different orders (each call only holds that
+// order's own orderLocks entry, never a zone-wide lock), so without a lock
+// here two such calls could race on that zone's chunkAlloc.cursor/remaining,
+// or on earlyAllocWatermark, and end up handing two different bitmap chunks
+// the same backing address. Chunk carving only happens the first time a
+// part of the address range is touched, so a single global lock here costs
+// nothing on the hot allocation path.
+var chunkAllocLock kernelsync.Spinlock
+
+// allocChunk returns a freshly carved, fully-reserved bitmapChunk.
+func (c *chunkAllocator) allocChunk() (*bitmapChunk, error) {
+	chunkSize := uint64(unsafe.Sizeof(bitmapChunk{}))
+
+	chunkAllocLock.Lock()
+	defer chunkAllocLock.Unlock()
+
+	if c.remaining < chunkSize {
+		if err := c.refill(chunkSize); err != nil {
+			return nil, err
+		}
+	}
+
+	addr := c.cursor
+	c.cursor += chunkSize
+	c.remaining -= chunkSize
+	if c.cursor > earlyAllocWatermark {
+		earlyAllocWatermark = c.cursor
+	}
+
+	chunk := (*bitmapChunk)(unsafe.Pointer(uintptr(addr)))
+	memsetFn(uintptr(addr), 0xFF, uint32(chunkSize))
+	chunk.allOnes = math.MaxUint64
+
+	return chunk, nil
+}
+
+// currentEarlyAllocWatermark returns the current value of
+// earlyAllocWatermark, synchronized with allocChunk. zone.init uses it to
+// find the range of physical memory its own chunkAllocator carved out while
+// bootstrapping, so that range can be reserved in the zone's own bitmaps.
+func currentEarlyAllocWatermark() uint64 {
+	chunkAllocLock.Lock()
+	defer chunkAllocLock.Unlock()
+
+	return earlyAllocWatermark
+}
+
+// refill scans the multiboot memory map for an available region that can
+// provide at least minSize bytes at or after earlyAllocWatermark.
+func (c *chunkAllocator) refill(minSize uint64) error {
+	var found bool
+	visitMemRegionFn(func(entry *multiboot.MemoryMapEntry) {
+		if found || entry.Type != multiboot.MemAvailable {
+			return
+		}
+
+		start := entry.PhysAddress
+		if start < earlyAllocWatermark {
+			start = earlyAllocWatermark
+		}
+		start = uint64(mem.Align(start, 8*mem.Byte))
+
+		end := entry.PhysAddress + entry.Length
+		if end <= start || end-start < minSize {
+			return
+		}
+
+		found = true
+		c.cursor = start
+		c.remaining = end - start
+	})
+
+	if !found {
+		return mem.ErrOutOfMemory
+	}
+
+	return nil
+}
+
+// ensureChunk returns the L2 chunk covering l1Index for the given order,
+// lazily carving one out of early multiboot memory (via z.chunkAlloc) the
+// first time that part of the address range is touched. A freshly
+// materialized chunk starts out fully reserved, mirroring the fact that no
+// address range is handed out until init's second pass (or a later split)
+// explicitly frees part of it.
+func (z *zone) ensureChunk(order mem.PageOrder, l1Index uint32) *bitmapChunk {
+	bm := &z.freeBitmap[order]
+	for uint32(len(bm.l1)) <= l1Index {
+		bm.l1 = append(bm.l1, nil)
+	}
+
+	if bm.l1[l1Index] == nil {
+		chunk, err := z.chunkAlloc.allocChunk()
+		if err != nil {
+			// Running out of memory while building the allocator's
+			// own bookkeeping this early in boot is unrecoverable.
+			panic("physical: out of early memory for bitmap chunk")
+		}
+		bm.l1[l1Index] = chunk
+	}
+
+	return bm.l1[l1Index]
+}
+
+// wordAt returns a pointer to the storage word covering the flat word
+// index block (i.e. bitIndex>>6) in this order's bitmap, lazily
+// materializing the L2 chunk that backs it.
+func (z *zone) wordAt(order mem.PageOrder, block uint32) (*uint64, *bitmapChunk) {
+	l1Index := block / bitmapChunkWords
+	chunk := z.ensureChunk(order, l1Index)
+	return &chunk.words[block%bitmapChunkWords], chunk
+}
+
+// testBitLocked is the unlocked primitive behind testBit. Callers must
+// already hold orderLocks[order] (directly, or transitively via a function
+// such as reserveFreePage that locks the whole order for the duration of a
+// larger operation).
+func (z *zone) testBitLocked(order mem.PageOrder, bitIndex uint32) bool {
+	bm := &z.freeBitmap[order]
+	l1Index := (bitIndex >> 6) / bitmapChunkWords
+	if int(l1Index) >= len(bm.l1) || bm.l1[l1Index] == nil {
+		return true
+	}
+
+	word := bm.l1[l1Index].words[(bitIndex>>6)%bitmapChunkWords]
+	mask := uint64(1 << (63 - (bitIndex & 63)))
+	return word&mask == mask
+}
+
+// testBit reports whether the bit for bitIndex in this order's bitmap is
+// set (reserved). A chunk that has never been materialized is treated as
+// fully reserved.
+func (z *zone) testBit(order mem.PageOrder, bitIndex uint32) bool {
+	z.orderLocks[order].Lock()
+	defer z.orderLocks[order].Unlock()
+
+	return z.testBitLocked(order, bitIndex)
+}
+
+// setBitLocked is the unlocked primitive behind setBit; see testBitLocked
+// for the locking contract callers must uphold.
+func (z *zone) setBitLocked(order mem.PageOrder, bitIndex uint32, reserved bool) {
+	word, chunk := z.wordAt(order, bitIndex>>6)
+	mask := uint64(1 << (63 - (bitIndex & 63)))
+
+	if reserved {
+		*word |= mask
+	} else {
+		*word &^= mask
+	}
+
+	z.syncAllOnes(chunk, (bitIndex>>6)%bitmapChunkWords)
+}
+
+// setBit sets (reserved=true) or clears (false) the bit for bitIndex in
+// this order's bitmap, lazily materializing the backing L2 chunk and
+// refreshing its "all ones" summary word.
+func (z *zone) setBit(order mem.PageOrder, bitIndex uint32, reserved bool) {
+	z.orderLocks[order].Lock()
+	defer z.orderLocks[order].Unlock()
+
+	z.setBitLocked(order, bitIndex, reserved)
+}
+
+// syncAllOnes refreshes chunk's allOnes summary bit for wordIndex after a
+// write to chunk.words[wordIndex].
+func (z *zone) syncAllOnes(chunk *bitmapChunk, wordIndex uint32) {
+	if chunk.words[wordIndex] == math.MaxUint64 {
+		chunk.allOnes |= 1 << (63 - wordIndex)
+	} else {
+		chunk.allOnes &^= 1 << (63 - wordIndex)
+	}
+}
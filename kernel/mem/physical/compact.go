@@ -0,0 +1,313 @@
+package physical
+
+import (
+	kernelsync "github.com/achilleasa/gopher-os/kernel/sync"
+
+	"github.com/achilleasa/gopher-os/kernel/errors"
+	"github.com/achilleasa/gopher-os/kernel/mem"
+)
+
+// Tag identifies the kind of owner a physical page was allocated for. The
+// active memory compactor uses a page's tag to look up the PageMover
+// registered for it and decide whether the page may be relocated.
+type Tag uint8
+
+const (
+	// TagAnonymous marks pages backing general-purpose kernel heap
+	// allocations. This is the tag AllocatePage assigns by default.
+	TagAnonymous Tag = iota
+
+	// TagKernelText marks pages backing the running kernel's code.
+	TagKernelText
+
+	// TagKernelData marks pages backing the running kernel's static data.
+	TagKernelData
+)
+
+// PageMover relocates the contents of a physical page that Compact has
+// decided to move and fixes up anything that still points at its old
+// address (page table entries, internal pointers, ...).
+type PageMover interface {
+	// MovePage is invoked after the byte contents of oldAddr have
+	// already been copied to newAddr. Implementations must update any
+	// virtual mappings, or other bookkeeping, that still reference
+	// oldAddr so that callers observe no difference after the move.
+	MovePage(oldAddr, newAddr uintptr) error
+}
+
+// pageMovers associates a Tag with the PageMover responsible for relocating
+// pages allocated with that tag. Tags with no registered mover (including
+// the allocator's own bitmap storage, DMA buffers and page tables, none of
+// which ever call RegisterPageMover) are treated as pinned by Compact.
+var pageMovers = make(map[Tag]PageMover)
+
+// RegisterPageMover associates tag with mover, making pages allocated with
+// that tag eligible for relocation by Compact.
+func RegisterPageMover(tag Tag, mover PageMover) {
+	pageMovers[tag] = mover
+}
+
+var (
+	// ErrNothingToCompact is returned by Compact when no pair of
+	// MaxPageOrder blocks suitable for compaction could be found.
+	ErrNothingToCompact = errors.KernelError("no suitable block pair found for compaction")
+
+	// ErrPageNotMovable is returned by Compact when a source block
+	// contains a page whose tag has no registered PageMover.
+	ErrPageNotMovable = errors.KernelError("block contains a page that cannot be relocated")
+
+	// Overriden by tests
+	memcopyFn = mem.Memcopy
+
+	tagLock  kernelsync.Spinlock
+	pageTags = make(map[uint32]Tag)
+)
+
+// pageTagKey returns the key used to index pageTags for the page at addr.
+func pageTagKey(addr uintptr) uint32 {
+	return uint32(addr >> mem.PageShift)
+}
+
+// setPageTag records tag as the owner of the page at addr.
+func setPageTag(addr uintptr, tag Tag) {
+	tagLock.Lock()
+	pageTags[pageTagKey(addr)] = tag
+	tagLock.Unlock()
+}
+
+// clearPageTag forgets the tag recorded for the page at addr. It is called
+// once a page is returned to a zone's free bitmaps.
+func clearPageTag(addr uintptr) {
+	tagLock.Lock()
+	delete(pageTags, pageTagKey(addr))
+	tagLock.Unlock()
+}
+
+// tagForAddr returns the tag recorded for the page at addr, if any.
+func tagForAddr(addr uintptr) (Tag, bool) {
+	tagLock.Lock()
+	defer tagLock.Unlock()
+
+	tag, ok := pageTags[pageTagKey(addr)]
+	return tag, ok
+}
+
+// Compact attempts to increase the number of free blocks at targetOrder and
+// above by relocating the movable pages out of a sparsely-free MaxPageOrder
+// block and into one that is mostly free, within ZoneNormal.
+//
+// A MaxPageOrder block is chosen as the compaction source if most of its
+// order-0 pages are allocated but it still has a handful of free buddies
+// scattered throughout it - so few that they are unlikely to ever coalesce
+// back into a free MaxPageOrder block on their own. A block is chosen as the
+// destination if it is the fullest block that still has enough free pages to
+// receive every allocated page out of the source: picking the emptiest
+// candidate instead would tend to land on a block that is already entirely
+// free, turning it reserved while the source becomes free for a net change
+// of zero free MaxPageOrder blocks. Every allocated page in the source block
+// is then relocated into a free page of the
+// destination block: its recorded Tag is used to look up a PageMover,
+// which is asked to fix up any virtual mappings after the page contents
+// are copied. A source page whose tag has no registered PageMover (the
+// allocator's own bitmap storage, DMA buffers, page tables, ...) aborts the
+// whole pass, since leaving it behind would defeat the point of vacating
+// the block.
+//
+// On success, freeCount[MaxPageOrder] for ZoneNormal is strictly greater
+// than it was before the call.
+func (alloc *buddyAllocator) Compact(targetOrder mem.PageOrder) error {
+	if targetOrder > mem.MaxPageOrder {
+		return errors.ErrInvalidParamValue
+	}
+
+	z := &alloc.zones[ZoneNormal]
+
+	z.globalLock.Lock()
+	defer z.globalLock.Unlock()
+
+	srcBlock, ok := z.findCompactionSource()
+	if !ok {
+		return ErrNothingToCompact
+	}
+
+	dstBlock, ok := z.findCompactionDestination(srcBlock)
+	if !ok {
+		return ErrNothingToCompact
+	}
+
+	return z.compactBlock(srcBlock, dstBlock)
+}
+
+// blockCount returns the number of MaxPageOrder blocks tracked by the zone.
+func (z *zone) blockCount() uint32 {
+	return z.pageCount >> mem.MaxPageOrder
+}
+
+// blockFreePageCount returns the number of free order-0 pages within the
+// MaxPageOrder block identified by blockIndex.
+func (z *zone) blockFreePageCount(blockIndex uint32) uint32 {
+	pagesPerBlock := uint32(1) << mem.MaxPageOrder
+	firstPage := blockIndex * pagesPerBlock
+
+	var free uint32
+	for p := uint32(0); p < pagesPerBlock; p++ {
+		if !z.testBit(0, firstPage+p) {
+			free++
+		}
+	}
+
+	return free
+}
+
+// findCompactionSource looks for the MaxPageOrder block with the fewest
+// (but more than zero, and fewer than all) free order-0 pages; such a block
+// is mostly reserved and therefore a good compaction candidate.
+func (z *zone) findCompactionSource() (uint32, bool) {
+	pagesPerBlock := uint32(1) << mem.MaxPageOrder
+
+	var (
+		found     bool
+		bestBlock uint32
+		bestFree  = ^uint32(0)
+	)
+
+	for blockIndex := uint32(0); blockIndex < z.blockCount(); blockIndex++ {
+		free := z.blockFreePageCount(blockIndex)
+		if free == 0 || free == pagesPerBlock {
+			// Already fully reserved or entirely free; nothing to gain
+			// from moving pages out.
+			continue
+		}
+
+		if free < bestFree {
+			found, bestBlock, bestFree = true, blockIndex, free
+		}
+	}
+
+	return bestBlock, found
+}
+
+// findCompactionDestination looks for the MaxPageOrder block (other than
+// exclude) with the fewest free order-0 pages, provided it still has enough
+// room to receive every allocated page currently in exclude. Preferring the
+// fullest qualifying block over the emptiest one keeps compaction from
+// picking a destination that is already entirely free: reserving the
+// source's pages into such a block would just swap which block holds that
+// distinction, for no net gain in free MaxPageOrder blocks.
+func (z *zone) findCompactionDestination(exclude uint32) (uint32, bool) {
+	pagesPerBlock := uint32(1) << mem.MaxPageOrder
+	needed := pagesPerBlock - z.blockFreePageCount(exclude)
+
+	var (
+		found     bool
+		bestBlock uint32
+		bestFree  = pagesPerBlock + 1
+	)
+
+	for blockIndex := uint32(0); blockIndex < z.blockCount(); blockIndex++ {
+		if blockIndex == exclude {
+			continue
+		}
+
+		free := z.blockFreePageCount(blockIndex)
+		// A block that is already entirely free would give no net
+		// gain (see above) and must never be picked.
+		if free == pagesPerBlock {
+			continue
+		}
+
+		if free >= needed && free < bestFree {
+			found, bestBlock, bestFree = true, blockIndex, free
+		}
+	}
+
+	return bestBlock, found
+}
+
+// compactBlock relocates every allocated order-0 page in the srcBlock
+// MaxPageOrder block into free pages of the dstBlock MaxPageOrder block.
+func (z *zone) compactBlock(srcBlock, dstBlock uint32) error {
+	pagesPerBlock := uint32(1) << mem.MaxPageOrder
+	dstFirstPage := dstBlock * pagesPerBlock
+	srcFirstPage := srcBlock * pagesPerBlock
+
+	dstCursor := uint32(0)
+
+	for p := uint32(0); p < pagesPerBlock; p++ {
+		srcBitIndex := srcFirstPage + p
+		if !z.testBit(0, srcBitIndex) {
+			// Already free; nothing to relocate.
+			continue
+		}
+
+		srcAddr := z.startAddr + uintptr(srcFirstPage+p)*uintptr(mem.PageSize)
+
+		tag, ok := tagForAddr(srcAddr)
+		if !ok {
+			return ErrPageNotMovable
+		}
+
+		mover, ok := pageMovers[tag]
+		if !ok {
+			return ErrPageNotMovable
+		}
+
+		dstAddr, err := z.nextFreePageInBlock(dstFirstPage, &dstCursor)
+		if err != nil {
+			return err
+		}
+
+		memcopyFn(dstAddr, srcAddr, uint32(mem.PageSize))
+
+		if err := mover.MovePage(srcAddr, dstAddr); err != nil {
+			return err
+		}
+
+		if err := z.reserveSpecificPage(dstAddr); err != nil {
+			return err
+		}
+		if err := z.freePage(srcAddr, 0); err != nil {
+			return err
+		}
+
+		setPageTag(dstAddr, tag)
+		clearPageTag(srcAddr)
+	}
+
+	return nil
+}
+
+// nextFreePageInBlock returns the address of the next free order-0 page at
+// or after *cursor within the MaxPageOrder block starting at firstPage,
+// advancing *cursor past it.
+func (z *zone) nextFreePageInBlock(firstPage uint32, cursor *uint32) (uintptr, error) {
+	pagesPerBlock := uint32(1) << mem.MaxPageOrder
+
+	for ; *cursor < pagesPerBlock; *cursor++ {
+		bitIndex := firstPage + *cursor
+		if !z.testBit(0, bitIndex) {
+			addr := z.startAddr + uintptr(bitIndex)*uintptr(mem.PageSize)
+			*cursor++
+			return addr, nil
+		}
+	}
+
+	return 0, mem.ErrOutOfMemory
+}
+
+// reserveSpecificPage marks the known-free order-0 page at addr as
+// reserved, propagating the change to the higher order bitmaps. It is the
+// mirror image of zone.freePage and is only used by the compactor, which
+// already knows addr is free.
+func (z *zone) reserveSpecificPage(addr uintptr) error {
+	bitIndex := z.pageIndex(addr, 0)
+	if z.testBit(0, bitIndex) {
+		return ErrPageNotAllocated
+	}
+
+	z.setBit(0, bitIndex, true)
+	z.addFreeCount(0, -1)
+	z.updateHigherOrderBitmaps(addr, 0)
+
+	return nil
+}
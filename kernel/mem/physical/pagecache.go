@@ -0,0 +1,134 @@
+package physical
+
+import (
+	"math"
+	"math/bits"
+
+	kernelsync "github.com/achilleasa/gopher-os/kernel/sync"
+
+	"github.com/achilleasa/gopher-os/kernel/mem"
+)
+
+const (
+	// pageCacheEntryBits defines the number of pages tracked by a single
+	// per-CPU page cache entry. Each set bit in the entry's cache bitmap
+	// indicates that the corresponding page inside its chunk is free.
+	pageCacheEntryBits = 64
+
+	// pageCacheOrder is the buddy allocator order used to refill a
+	// per-CPU page cache entry. A single refill reserves a contiguous
+	// run of pageCacheEntryBits pages from the buddy allocator.
+	pageCacheOrder = mem.PageOrder(6)
+
+	// pageCacheMaxOrder is the highest allocation order that the
+	// per-CPU page cache fast path is able to serve. Requests for a
+	// higher order always fall back to the buddy allocator.
+	pageCacheMaxOrder = mem.PageOrder(0)
+
+	// maxCachedCPU bounds the number of per-CPU page cache entries
+	// tracked by the allocator. It is a placeholder until the HAL
+	// exposes the actual number of online CPUs.
+	maxCachedCPU = 32
+)
+
+// pageCacheEntry describes a small, per-CPU cache of individual pages carved
+// out of a single contiguous run reserved from the buddy allocator. A set
+// bit in cache indicates that the page at base+(bit*mem.PageSize) is free.
+//
+// Serving order-0 allocations and frees out of a pageCacheEntry avoids
+// taking the buddy allocator's shared locks on the hot path, mirroring the
+// per-P page cache used by the Go runtime's page allocator.
+type pageCacheEntry struct {
+	lock  kernelsync.Spinlock
+	base  uintptr
+	cache uint64
+}
+
+// cpuIDFn returns the index of the pageCacheEntry that should serve the
+// calling CPU. It always returns 0 until the HAL exposes a way to query the
+// executing CPU's id; tests override it to exercise multiple entries.
+var cpuIDFn = func() uint32 { return 0 }
+
+// cachedPage attempts to satisfy an order-0 allocation using the current
+// CPU's page cache entry without touching the buddy allocator's shared
+// bitmaps. The ok return value is false if the entry is empty and needs to
+// be refilled via refillCache.
+func (alloc *buddyAllocator) cachedPage(order mem.PageOrder) (uintptr, bool) {
+	if order > pageCacheMaxOrder {
+		return 0, false
+	}
+
+	entry := &alloc.cpuCache[cpuIDFn()%maxCachedCPU]
+
+	entry.lock.Lock()
+	defer entry.lock.Unlock()
+
+	if entry.cache == 0 {
+		return 0, false
+	}
+
+	bitIndex := bits.TrailingZeros64(entry.cache)
+	entry.cache &^= 1 << uint(bitIndex)
+
+	return entry.base + (uintptr(bitIndex) << mem.PageShift), true
+}
+
+// refillCache reserves a contiguous run of pageCacheEntryBits pages from the
+// buddy allocator and uses it to replenish the current CPU's page cache
+// entry. The reservation is made via reservePage rather than the counted
+// allocatePageLockedForOwner path: the run is not itself a page handed back
+// to a caller, only the individual cached pages carved out of it are (and
+// each of those is counted when it is actually served), so counting the run
+// as well would inflate Allocations past Frees. The reservation is
+// performed without entry.lock held, so two callers can race to refill the
+// same entry (today, every CPU shares entry 0 until the HAL can report real
+// CPU ids). The entry is re-checked under entry.lock before being
+// overwritten so the loser of that race gives its run back instead of
+// leaking it.
+func (alloc *buddyAllocator) refillCache() error {
+	addr, err := alloc.reservePage(pageCacheOrder, FlagDoNotClear, TagAnonymous)
+	if err != nil {
+		return err
+	}
+
+	entry := &alloc.cpuCache[cpuIDFn()%maxCachedCPU]
+
+	entry.lock.Lock()
+	if entry.cache != 0 {
+		// Another refill already populated this entry while we were
+		// reserving addr; give it back rather than overwriting and
+		// leaking it.
+		entry.lock.Unlock()
+		return alloc.releasePage(addr, pageCacheOrder)
+	}
+	entry.base = addr
+	entry.cache = math.MaxUint64
+	entry.lock.Unlock()
+
+	return nil
+}
+
+// freeCachedPage attempts to release addr back into the per-CPU page cache
+// entry that owns the chunk containing it. It returns false if addr does
+// not fall within any entry's chunk, in which case the caller should fall
+// back to the regular buddy allocator free path.
+func (alloc *buddyAllocator) freeCachedPage(addr uintptr, order mem.PageOrder) bool {
+	if order > pageCacheMaxOrder {
+		return false
+	}
+
+	chunkSize := uintptr(pageCacheEntryBits) << mem.PageShift
+	for i := range alloc.cpuCache {
+		entry := &alloc.cpuCache[i]
+
+		entry.lock.Lock()
+		if entry.base != 0 && addr >= entry.base && addr < entry.base+chunkSize {
+			entry.cache |= 1 << uint((addr-entry.base)>>mem.PageShift)
+			entry.lock.Unlock()
+			return true
+		}
+		entry.lock.Unlock()
+	}
+
+	return false
+}
@@ -0,0 +1,54 @@
+package physical
+
+import (
+	"sync/atomic"
+
+	"github.com/achilleasa/gopher-os/kernel/mem"
+)
+
+// Stats is a point-in-time snapshot of a buddyAllocator's activity counters.
+// Every field is read with an atomic load, so the snapshot as a whole is not
+// guaranteed to be internally consistent under concurrent allocations and
+// frees, but each individual field is accurate at the moment it was read.
+type Stats struct {
+	// FreeCount holds the number of free pages at each allocation order,
+	// summed across every zone.
+	FreeCount [mem.MaxPageOrder + 1]uint32
+
+	// Allocations and Frees count successful calls to AllocatePage (or
+	// AllocatePageForOwner) and FreePage, respectively.
+	Allocations uint64
+	Frees       uint64
+
+	// FailedAllocations counts calls to AllocatePage/AllocatePageForOwner
+	// that returned an error, either because no zone had a free page to
+	// offer or because the requested order exceeded mem.MaxPageOrder.
+	FailedAllocations uint64
+
+	// Splits and Merges count, across every zone, the number of times a
+	// higher order page was carved into two lower order buddies and the
+	// number of times two free buddies were coalesced back into their
+	// parent order.
+	Splits uint64
+	Merges uint64
+}
+
+// Stats returns a snapshot of alloc's activity counters.
+func (alloc *buddyAllocator) Stats() Stats {
+	stats := Stats{
+		Allocations:       atomic.LoadUint64(&alloc.allocations),
+		Frees:             atomic.LoadUint64(&alloc.frees),
+		FailedAllocations: atomic.LoadUint64(&alloc.failedAllocations),
+	}
+
+	for i := range alloc.zones {
+		z := &alloc.zones[i]
+		for order := range z.freeCount {
+			stats.FreeCount[order] += z.loadFreeCount(mem.PageOrder(order))
+		}
+		stats.Splits += atomic.LoadUint64(&z.splits)
+		stats.Merges += atomic.LoadUint64(&z.merges)
+	}
+
+	return stats
+}
@@ -0,0 +1,508 @@
+package physical
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/achilleasa/gopher-os/kernel/errors"
+	"github.com/achilleasa/gopher-os/kernel/hal/multiboot"
+	"github.com/achilleasa/gopher-os/kernel/mem"
+	kernelsync "github.com/achilleasa/gopher-os/kernel/sync"
+)
+
+// Zone identifies one of the physical memory regions tracked by the
+// allocator. Each zone maintains its own set of buddy bitmaps so that
+// allocations made from one zone never consume pages that belong to
+// another.
+type Zone uint8
+
+const (
+	// ZoneDMA covers physical memory below dmaZoneLimit. Legacy ISA-style
+	// devices can only perform DMA into this range, so it is kept
+	// separate to avoid Normal-zone pressure starving those drivers.
+	ZoneDMA Zone = iota
+
+	// ZoneNormal covers general purpose physical memory above
+	// dmaZoneLimit and below the reserve watermark carved out at the
+	// top of memory.
+	ZoneNormal
+
+	// ZoneReserve is a small emergency pool carved out of the highest
+	// available addresses. Pages in this zone are only handed out to
+	// callers that pass FlagEmergency, guaranteeing that a few pages
+	// remain available even when ZoneDMA and ZoneNormal are exhausted.
+	ZoneReserve
+
+	// zoneCount is a sentinel equal to the number of defined zones.
+	zoneCount
+)
+
+const (
+	// dmaZoneLimit is the exclusive upper bound of ZoneDMA. Addresses
+	// below this limit are reachable by legacy ISA-style DMA controllers.
+	dmaZoneLimit = 16 << 20
+
+	// reserveZonePages is the number of order-0 pages set aside at the
+	// top of memory for ZoneReserve.
+	reserveZonePages = 256
+)
+
+// zone tracks the buddy bitmaps for a contiguous sub-range of the physical
+// address space. Its fields mirror what buddyAllocator used to keep as a
+// single, machine-wide set of bitmaps; splitting them out allows the
+// allocator to reason about DMA/Normal/Reserve memory independently.
+type zone struct {
+	// startAddr is the first physical address covered by this zone. All
+	// bitmap indices for this zone are relative to startAddr.
+	startAddr uintptr
+
+	// pageCount is the number of order-0 pages covered by this zone.
+	pageCount uint32
+
+	// freeCount stores the number of free pages for each allocation order.
+	// Initially, only the last order contains free pages. Having a free
+	// counter allows us to quickly detect when the lower orders have no
+	// pages available so we can immediately start scanning the higher
+	// orders. Entries are only ever accessed through addFreeCount and
+	// loadFreeCount, which update them atomically so that a reader never
+	// needs to hold an orderLocks entry just to consult the count.
+	freeCount [mem.MaxPageOrder + 1]uint32
+
+	// freeBitmap stores the free page bitmap for each allocation order as
+	// a sparse, two-level array of bitmapChunks (see bitmap.go). This
+	// lets the zone skip committing any storage at all for address
+	// ranges that never back real RAM, and lets the hot-path scans in
+	// reserveFreePage short-circuit whole chunks that are entirely
+	// allocated.
+	freeBitmap [mem.MaxPageOrder + 1]bitmap
+
+	// chunkAlloc carves the storage for this zone's bitmap chunks out of
+	// early multiboot memory, lazily, as they are first touched.
+	chunkAlloc chunkAllocator
+
+	// orderLocks holds one spinlock per allocation order, guarding that
+	// order's bitmap words. A single-order operation (reserveFreePage,
+	// testBit, setBit) only ever takes its own entry, so unrelated
+	// orders never contend with each other. An operation that must look
+	// at two orders at once (updateHigherOrderBitmaps) always locks the
+	// lower order before the higher one, to avoid deadlocking against
+	// another such operation walking the same chain.
+	orderLocks [mem.MaxPageOrder + 1]kernelsync.Spinlock
+
+	// globalLock serializes the cross-order transitions performed by
+	// splitHigherOrderPage and, for ZoneNormal, Compact: operations that
+	// donate or relocate pages between orders rather than operating on a
+	// single one. It is distinct from orderLocks so that unrelated
+	// single-order work never blocks behind it.
+	globalLock kernelsync.Spinlock
+
+	// splits and merges count, respectively, the number of times
+	// splitHigherOrderPage has carved a free page into two lower-order
+	// buddies and the number of times updateHigherOrderBitmaps has
+	// coalesced two free buddies back into their free parent. Both are
+	// updated with atomic.AddUint64 and surfaced via Stats.
+	splits uint64
+	merges uint64
+}
+
+// addFreeCount atomically adjusts the free page counter for order by delta,
+// which may be negative.
+func (z *zone) addFreeCount(order mem.PageOrder, delta int32) {
+	atomic.AddUint32(&z.freeCount[order], uint32(delta))
+}
+
+// loadFreeCount atomically returns the free page counter for order.
+func (z *zone) loadFreeCount(order mem.PageOrder) uint32 {
+	return atomic.LoadUint32(&z.freeCount[order])
+}
+
+// init bootstraps a single zone's buddy bitmaps using only the available
+// memory regions that fall within [start, end). Unlike the flat-bitmap
+// layout this replaced, init no longer needs to find one region large
+// enough to hold every order's bitmap: it simply walks each available
+// region of the zone in consecutive MaxPageOrder-sized blocks, starting
+// from the region's first 8-byte aligned address, and marks each one free,
+// letting setBit lazily materialize whatever bitmap chunks that touches.
+//
+// That lazy materialization carves its storage out of the same available
+// memory this loop is marking free, from whatever address
+// earlyAllocWatermark has reached so far - which, for this zone, usually
+// falls inside one of the very blocks the loop is about to free. Once the
+// loop is done, reserveBitmapStorage reclaims whatever range this zone's own
+// carving consumed, so reserveFreePage can never later hand out a page that
+// physically backs the allocator's own bitmap chunks.
+func (z *zone) init(start, end uint64) error {
+	z.startAddr = uintptr(start)
+	z.pageCount = uint32((end - start) / uint64(mem.PageSize))
+
+	carveStart := currentEarlyAllocWatermark()
+
+	maxOrderPageSize := uint64(mem.PageSize << mem.MaxPageOrder)
+	visitMemRegionFn(func(entry *multiboot.MemoryMapEntry) {
+		if entry.Type != multiboot.MemAvailable {
+			return
+		}
+
+		regionStart, regionLen := clipRegion(entry.PhysAddress, entry.Length, start, end)
+		if regionLen == 0 {
+			return
+		}
+
+		alignedAddr := mem.Align(regionStart, 8*mem.Byte)
+		alignedLen := regionLen - (alignedAddr - regionStart)
+
+		pageBlocks := alignedLen / maxOrderPageSize
+		for index := uint64(0); index < pageBlocks; index++ {
+			blockAddr := alignedAddr + (index * maxOrderPageSize)
+			bitIndex := z.pageIndex(uintptr(blockAddr), mem.MaxPageOrder)
+
+			z.setBit(mem.MaxPageOrder, bitIndex, false)
+			z.addFreeCount(mem.MaxPageOrder, 1)
+		}
+	})
+
+	z.reserveBitmapStorage(carveStart, currentEarlyAllocWatermark())
+
+	return nil
+}
+
+// reserveBitmapStorage marks every order-0 page in [start, end) reserved in
+// this zone's own bitmaps, propagating the change up through every higher
+// order exactly as freePage's reverse would. Pages outside this zone's own
+// range are skipped: earlyAllocWatermark is shared across zones, so the
+// range carved while this zone was initializing may extend past it.
+//
+// Unlike reserveSpecificPage, this does not decrement the order-0 free
+// count: init never added these pages to it in the first place, since it
+// only ever frees whole MaxPageOrder blocks, never individual order-0
+// pages.
+func (z *zone) reserveBitmapStorage(start, end uint64) {
+	for addr := start; addr < end; addr += uint64(mem.PageSize) {
+		if !z.contains(uintptr(addr)) {
+			continue
+		}
+
+		bitIndex := z.pageIndex(uintptr(addr), 0)
+		z.setBit(0, bitIndex, true)
+		z.updateHigherOrderBitmaps(uintptr(addr), 0)
+	}
+}
+
+// clipRegion intersects [regionAddr, regionAddr+regionLen) with [lo, hi) and
+// returns the resulting start address and length, or a zero length if the
+// two ranges do not overlap.
+func clipRegion(regionAddr, regionLen, lo, hi uint64) (uint64, uint64) {
+	start := regionAddr
+	if start < lo {
+		start = lo
+	}
+
+	end := regionAddr + regionLen
+	if end > hi {
+		end = hi
+	}
+
+	if end <= start {
+		return 0, 0
+	}
+
+	return start, end - start
+}
+
+// contains returns true if addr falls within the physical address range
+// covered by this zone.
+func (z *zone) contains(addr uintptr) bool {
+	return addr >= z.startAddr && addr < z.startAddr+(uintptr(z.pageCount)<<mem.PageShift)
+}
+
+// pageIndex returns the index of the bit in this zone's bitmap for the
+// given order that corresponds to the page located at addr.
+func (z *zone) pageIndex(addr uintptr, order mem.PageOrder) uint32 {
+	return uint32((addr - z.startAddr) >> (mem.PageShift + order))
+}
+
+// allocatePage is the zone-local equivalent of buddyAllocator.allocatePageLockedForOwner.
+//
+// The fast path, taken when order already has a free page, only ever takes
+// orderLocks[order] (inside reserveFreePage). Only the slow path, which must
+// split a higher order page to make room, also takes globalLock.
+func (z *zone) allocatePage(order mem.PageOrder) (uintptr, error) {
+	if order > mem.MaxPageOrder {
+		return uintptr(0), errors.ErrInvalidParamValue
+	}
+
+	addr, err := z.reserveFreePage(order)
+	if err == mem.ErrOutOfMemory {
+		z.globalLock.Lock()
+		if err = z.splitHigherOrderPage(order); err == nil {
+			addr, err = z.reserveFreePage(order)
+		}
+		z.globalLock.Unlock()
+	}
+	if err != nil {
+		return uintptr(0), err
+	}
+
+	z.updateLowerOrderBitmaps(addr, order, markReserved)
+	z.updateHigherOrderBitmaps(addr, order)
+
+	return addr, nil
+}
+
+// freePage is the zone-local equivalent of buddyAllocator.freePageLocked.
+func (z *zone) freePage(addr uintptr, order mem.PageOrder) error {
+	if order > mem.MaxPageOrder {
+		return errors.ErrInvalidParamValue
+	}
+
+	bitIndex := z.pageIndex(addr, order)
+
+	z.orderLocks[order].Lock()
+	if !z.testBitLocked(order, bitIndex) {
+		z.orderLocks[order].Unlock()
+		return ErrPageNotAllocated
+	}
+	z.setBitLocked(order, bitIndex, false)
+	z.orderLocks[order].Unlock()
+	z.addFreeCount(order, 1)
+
+	// Propagate the changes to the other orders
+	z.updateLowerOrderBitmaps(addr, order, markFree)
+	z.updateHigherOrderBitmaps(addr, order)
+
+	return nil
+}
+
+// splitHigherOrderPage searches for the first available page with order greater
+// than the requested order. If a free page is found, it is marked as reserved and
+// the free counts for the orders below it are updated accordingly.
+//
+// splitHigherOrderPage only ever looks at the zone it is called on. The
+// reserveZonePages worth of pages set aside for ZoneReserve are protected
+// from ordinary ZoneNormal/ZoneDMA pressure purely by zone separation:
+// ZoneReserve has its own freeBitmap/freeCount that splitHigherOrderPage run
+// on another zone can never reach, no matter how exhausted that zone is.
+// Callers that want to dip into ZoneReserve must pass FlagEmergency, which
+// buddyAllocator.zoneFallbackOrder uses to add it to the zones tried.
+//
+// Callers must already hold globalLock: over the course of a single call
+// splitHigherOrderPage reserves a page at one order and donates its space to
+// every order below it, so it touches more than one orderLocks entry.
+func (z *zone) splitHigherOrderPage(order mem.PageOrder) error {
+	for order = order + 1; order <= mem.MaxPageOrder; order++ {
+		if z.loadFreeCount(order) == 0 {
+			continue
+		}
+
+		// This order has free pages. Reserve the first available and
+		// make its space available to the order below it. A failure
+		// here means another allocation raced us for the last free
+		// page at this order; try the next one instead.
+		if _, err := z.reserveFreePage(order); err != nil {
+			continue
+		}
+
+		z.incFreeCountForLowerOrders(order)
+		atomic.AddUint64(&z.splits, 1)
+		return nil
+	}
+
+	return mem.ErrOutOfMemory
+}
+
+// reserveFreePage scans the free page bitmaps for the given order, reserves
+// the first available page and returns its address. If no pages at this
+// order are available then this method returns ErrOutOfMemory.
+//
+// It walks the order's sparse bitmap chunk by chunk, skipping any chunk
+// that has never been materialized (never backed by real RAM) or whose
+// allOnes summary word shows it is entirely allocated, before falling back
+// to a per-word and then per-bit scan. The whole scan runs under
+// orderLocks[order], so concurrent calls for other orders never contend
+// with it.
+func (z *zone) reserveFreePage(order mem.PageOrder) (uintptr, error) {
+	if order > mem.MaxPageOrder {
+		return uintptr(0), errors.ErrInvalidParamValue
+	}
+
+	z.orderLocks[order].Lock()
+	defer z.orderLocks[order].Unlock()
+
+	bm := &z.freeBitmap[order]
+	for l1Index, chunk := range bm.l1 {
+		if chunk == nil || chunk.allOnes == math.MaxUint64 {
+			continue
+		}
+
+		for wordIndex, word := range chunk.words {
+			// Entire word is allocated; skip it
+			if word == math.MaxUint64 {
+				continue
+			}
+
+			// Scan the individual bits to find the block and reserve it
+			for bitIndex := uint8(0); bitIndex < 64; bitIndex++ {
+				mask := uint64(1 << (63 - bitIndex))
+
+				// Ignore used bits
+				if (word & mask) != 0 {
+					continue
+				}
+
+				// Mark page as allocated and decrement the free page count for this order
+				chunk.words[wordIndex] |= mask
+				z.syncAllOnes(chunk, uint32(wordIndex))
+				z.addFreeCount(order, -1)
+
+				block := uint32(l1Index)*bitmapChunkWords + uint32(wordIndex)
+				return z.startAddr + uintptr(mem.PageSize)*((uintptr(block)<<6)+uintptr(bitIndex)), nil
+			}
+		}
+	}
+
+	return uintptr(0), mem.ErrOutOfMemory
+}
+
+// updateLowerOrderBitmaps hierarchically traverses the free bitmaps at the orders
+// below the supplied order and depending on the requested reservation mode either
+// sets or unsets the used bits that correspond to the supplied address.
+//
+// Each order's bitmap words are updated while holding only that order's
+// entry in orderLocks; no two orderLocks entries are ever held at once here.
+func (z *zone) updateLowerOrderBitmaps(addr uintptr, order mem.PageOrder, mode reservationMode) {
+	order--
+
+	var (
+		firstBitIndex                     = z.pageIndex(addr, order)
+		totalBitCount              uint32 = 2
+		bitsToChange, lastBitIndex uint32
+	)
+
+	for ; order >= 0 && order <= mem.MaxPageOrder; order = order - 1 {
+		lastBitIndex = firstBitIndex + totalBitCount
+
+		z.orderLocks[order].Lock()
+		for bitIndex := firstBitIndex; bitIndex < lastBitIndex; bitIndex += bitsToChange {
+			block := bitIndex >> 6
+			blockOffset := bitIndex & 63
+
+			// We need to change min(64, lastBitIndex - bitIndex) bits in this block
+			bitsToChange = lastBitIndex - bitIndex
+			if bitsToChange > 64 {
+				bitsToChange = 64
+			}
+
+			// To build the block mask we start with a value with the
+			// bitsToChange LSB set and shift it right so it alignts with
+			// the offset position in the block
+			blockMask := uint64(((1 << (bitsToChange)) - 1) << (64 - blockOffset - bitsToChange))
+
+			// Mark either as reserved (set to 1) or free (set to 0)
+			word, chunk := z.wordAt(order, block)
+			if mode == markReserved {
+				*word |= blockMask
+			} else {
+				*word &^= blockMask
+			}
+			z.syncAllOnes(chunk, block%bitmapChunkWords)
+		}
+		z.orderLocks[order].Unlock()
+
+		switch {
+		// Initially only the MaxPageOrder free count is > 0; all lower-order free counts are 0.
+		// If we directly allocate a MaxPageOrder page, this can cause an underflow
+		case mode == markReserved && z.loadFreeCount(order) >= totalBitCount:
+			z.addFreeCount(order, -int32(totalBitCount))
+		case mode == markFree:
+			z.addFreeCount(order, int32(totalBitCount))
+		}
+
+		// Each time we descend an order the first bit index and the number
+		// of bits we need to set/unset doubles
+		firstBitIndex <<= 1
+		totalBitCount <<= 1
+	}
+}
+
+// updateHigherOrderBitmaps hierarchically traverses the free bitmaps from lower
+// to higher orders and for each order, updates the page bit that corresponds
+// to the supplied physical address based on the value of the 2 buddy pages of
+// the order below it. The status of page at ord(N) is set to the OR-ed value
+// of the 2 buddy pages at ord(N-1).
+//
+// Each step inspects order-1's bitmap to decide order's bit, so it locks
+// both orderLocks[order-1] and orderLocks[order] for the duration of that
+// step. The two are always acquired in ascending order (child before
+// parent) to avoid deadlocking against another goroutine walking the same
+// chain.
+func (z *zone) updateHigherOrderBitmaps(addr uintptr, order mem.PageOrder) {
+	// sanity checks
+	if order > mem.MaxPageOrder {
+		return
+	}
+
+	// ord(0) has no children
+	if order == 0 {
+		order++
+	}
+
+	var bitIndex, block, childBitIndex, childBlock uint32
+	var blockMask, childBlockMask uint64
+	var wasReserved bool
+	for bitIndex = z.pageIndex(addr, order); order <= mem.MaxPageOrder; order, bitIndex = order+1, bitIndex>>1 {
+		block = bitIndex >> 6
+		blockMask = 1 << (63 - (bitIndex & 63))
+
+		// This bit should be marked as used any of the (ord-1) bits:
+		// (2*bit)+1 or (2*bit)+2 are marked as used. The child mask
+		// that includes these bits is calculated by shifting the
+		// value "3" (11b) left childBitIndex positions.
+		childBitIndex = (bitIndex << 1) + 1
+		childBlock = childBitIndex >> 6
+		childBlockMask = 3 << (63 - (childBitIndex & 63))
+
+		z.orderLocks[order-1].Lock()
+		z.orderLocks[order].Lock()
+
+		word, chunk := z.wordAt(order, block)
+		wasReserved = (*word & blockMask) == blockMask
+
+		childWord, _ := z.wordAt(order-1, childBlock)
+		switch *childWord & childBlockMask {
+		case 0: // both bits are not set; we just need to clear the bit
+			*word &^= blockMask
+
+			if wasReserved {
+				z.addFreeCount(order, 1)
+				atomic.AddUint64(&z.merges, 1)
+			}
+		default: // one or both bits are set; we just need to set the bit
+			*word |= blockMask
+
+			if !wasReserved {
+				z.addFreeCount(order, -1)
+			}
+		}
+
+		z.syncAllOnes(chunk, block%bitmapChunkWords)
+
+		z.orderLocks[order].Unlock()
+		z.orderLocks[order-1].Unlock()
+	}
+}
+
+// incFreeCountForLowerOrders is called when a free page at ord(N) is allocated
+// to update all free page counters for all orders less than or equal to N. The
+// number of free pages that are added to the counters doubles for each order less than N.
+func (z *zone) incFreeCountForLowerOrders(order mem.PageOrder) {
+	// sanity check
+	if order > mem.MaxPageOrder {
+		return
+	}
+
+	// When ord reaches 0; ord - 1 will wrap to MaxUint32 so we need to check for that as well
+	freeCount := uint32(2)
+	for order = order - 1; order >= 0 && order <= mem.MaxPageOrder; order, freeCount = order-1, freeCount<<1 {
+		z.addFreeCount(order, int32(freeCount))
+	}
+}
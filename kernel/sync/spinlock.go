@@ -0,0 +1,26 @@
+// Package sync provides minimal kernel-level synchronization primitives.
+// Unlike the standard library's sync package, these do not depend on the Go
+// scheduler to park blocked goroutines, which makes them usable from code
+// that may run before the scheduler is fully up (early boot, interrupt
+// handlers) or that must stay lock-free-ish across CPUs without OS support.
+package sync
+
+import "sync/atomic"
+
+// Spinlock is a test-and-set mutual exclusion lock that busy-waits instead
+// of blocking, matching the locking primitive used by small OS kernels for
+// data shared across CPUs.
+type Spinlock struct {
+	state uint32
+}
+
+// Lock blocks the calling goroutine until the spinlock can be acquired.
+func (l *Spinlock) Lock() {
+	for !atomic.CompareAndSwapUint32(&l.state, 0, 1) {
+	}
+}
+
+// Unlock releases the spinlock. The caller must already hold it.
+func (l *Spinlock) Unlock() {
+	atomic.StoreUint32(&l.state, 0)
+}